@@ -4,11 +4,16 @@
 package ratelimitclient
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
 	"golang.org/x/time/rate"
 	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,70 +21,832 @@ type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// RateLimiter decides when callers are allowed to proceed. Wait blocks (or
+// returns an error) until the caller may proceed or ctx is done. Allow reports
+// whether a caller may proceed right now, without waiting.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+	Allow() bool
+}
+
+// ErrRateLimited is returned by a non-blocking RateLimiter's Wait method when
+// no token is currently available.
+var ErrRateLimited = errors.New("ratelimitclient: rate limit exceeded")
+
+// tokenBucketLimiter is the RateLimiter used by NewClient: it blocks Wait
+// callers until a token is available.
+type tokenBucketLimiter struct {
+	limiter *rate.Limiter
+	// configuredRate is the rate the limiter was constructed with. syncFromHeaders
+	// reconciles the limiter's rate toward what the server reports, but never
+	// above configuredRate, so a generous server-reported window can't exceed
+	// the budget the caller asked for.
+	configuredRate rate.Limit
+}
+
+// NewTokenBucketLimiter returns a RateLimiter backed by golang.org/x/time/rate
+// that blocks Wait callers until a token is available. This is the limiter
+// NewClient uses by default, exposed so it can be shared across Clients.
+func NewTokenBucketLimiter(limit int, unit time.Duration) RateLimiter {
+	r := rate.Every(unit / time.Duration(limit))
+	return &tokenBucketLimiter{limiter: rate.NewLimiter(r, 1), configuredRate: r}
+}
+
+func (l *tokenBucketLimiter) Wait(ctx context.Context) error { return l.limiter.Wait(ctx) }
+func (l *tokenBucketLimiter) Allow() bool                    { return l.limiter.Allow() }
+
+// nonBlockingLimiter is a RateLimiter that never blocks: Wait fails fast with
+// ErrRateLimited instead of waiting for a token to free up.
+type nonBlockingLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewNonBlockingLimiter returns a RateLimiter backed by golang.org/x/time/rate
+// whose Wait method returns ErrRateLimited immediately instead of blocking
+// when no token is currently available.
+func NewNonBlockingLimiter(limit int, unit time.Duration) RateLimiter {
+	return &nonBlockingLimiter{limiter: rate.NewLimiter(rate.Every(unit/time.Duration(limit)), 1)}
+}
+
+func (l *nonBlockingLimiter) Wait(ctx context.Context) error {
+	if !l.limiter.Allow() {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+func (l *nonBlockingLimiter) Allow() bool { return l.limiter.Allow() }
+
+// RetryPolicy decides whether a response/error should be retried and, if so,
+// how long to wait before the next attempt. resp may be nil when err is non-nil.
+type RetryPolicy func(resp *http.Response, err error) (retry bool, delay time.Duration)
+
 type Client struct {
 	client HttpClient
-	limit  int
 	unit   time.Duration
 
 	Retries int
 
-	ctx         context.Context
-	rateLimiter *rate.Limiter
-	rateChan    chan struct{}
+	// RetryPolicy determines whether a request is retried and how long to wait
+	// between attempts. When nil, the client honors the Retry-After header on
+	// 429 and 503 responses and otherwise falls back to exponential backoff
+	// with full jitter.
+	RetryPolicy RetryPolicy
+
+	// MaxInFlight caps the number of requests allowed in flight concurrently,
+	// independent of rateLimiter. When <= 0, there is no cap.
+	MaxInFlight int
+
+	// KeyFunc derives a per-request rate-limit key from req, letting a single
+	// Client enforce separate budgets per destination host, per endpoint, or
+	// per authenticated user. When nil, all requests share rateLimiter.
+	KeyFunc func(req *http.Request) string
+
+	// NewKeyLimiter constructs the RateLimiter used the first time KeyFunc
+	// returns a given key. It must be set whenever KeyFunc is non-nil.
+	NewKeyLimiter func() RateLimiter
+
+	// MaxKeys bounds how many per-key limiters are kept in memory at once,
+	// evicting the least recently used key once the bound is exceeded.
+	// <= 0 means unbounded.
+	MaxKeys int
+
+	// HeaderParser enables HeaderSync mode: when set, Do inspects every
+	// response with it, blocks further requests while the server reports an
+	// exhausted quota, and adjusts the rate of a token-bucket rateLimiter (see
+	// NewTokenBucketLimiter) to the server's reported quota; other RateLimiters
+	// keep their own rate (see GitHubRateLimitHeaderParser, RFCRateLimitHeaderParser).
+	// Nil disables header syncing.
+	HeaderParser RateLimitHeaderParser
+
+	// CircuitBreakerThreshold is the number of failures within
+	// CircuitBreakerWindow that opens the circuit, short-circuiting further
+	// requests with ErrCircuitOpen until CircuitBreakerCooldown elapses.
+	// <= 0 disables the circuit breaker (the default).
+	CircuitBreakerThreshold int
+	// CircuitBreakerWindow is the rolling window over which failures are
+	// counted towards CircuitBreakerThreshold.
+	CircuitBreakerWindow time.Duration
+	// CircuitBreakerCooldown is how long the circuit stays open before a
+	// single half-open probe request is allowed through.
+	CircuitBreakerCooldown time.Duration
+	// CircuitBreakerStatusCodes are response status codes that count as
+	// failures for the circuit breaker, in addition to network errors, which
+	// always count. Empty by default, so only network errors trip it.
+	CircuitBreakerStatusCodes []int
+
+	// HedgeAfter, when > 0, makes Do fire a second, parallel attempt for an
+	// idempotent request (or one opted in via WithHedging) if the first
+	// attempt hasn't returned within HedgeAfter, taking whichever response
+	// comes back first. 0 disables hedging (the default).
+	HedgeAfter time.Duration
+
+	syncMu           sync.Mutex
+	syncBlockedUntil time.Time
+	circuit          circuitBreakerState
+	// priority gates admission to rateLimiter, the limiter used when KeyFunc
+	// is nil. Each per-key limiter in keyLimiters carries its own gate instead
+	// of sharing this one, so independent keys never serialize on each other.
+	priority priorityGate
+
+	ctx          context.Context
+	rateLimiter  RateLimiter
+	rateChan     chan struct{}
+	rateChanOnce sync.Once
+
+	keyLimitersMu sync.Mutex
+	keyLimiters   map[string]*list.Element
+	keyLRU        *list.List
+}
+
+// keyLimiterEntry is the value stored in a keyLRU element. Its priority gate
+// is scoped to this key alone, so admission ordering on one key's limiter
+// never blocks on another key's.
+type keyLimiterEntry struct {
+	key      string
+	limiter  RateLimiter
+	priority priorityGate
+}
+
+// limiterForRequest returns the RateLimiter that should gate req — the
+// per-key limiter named by KeyFunc, or c.rateLimiter when KeyFunc is nil —
+// together with the priorityGate scoped to that same limiter.
+func (c *Client) limiterForRequest(req *http.Request) (RateLimiter, *priorityGate) {
+	if c.KeyFunc == nil {
+		return c.rateLimiter, &c.priority
+	}
+	key := c.KeyFunc(req)
+
+	c.keyLimitersMu.Lock()
+	defer c.keyLimitersMu.Unlock()
+
+	if c.keyLimiters == nil {
+		c.keyLimiters = make(map[string]*list.Element)
+		c.keyLRU = list.New()
+	}
+	if el, ok := c.keyLimiters[key]; ok {
+		c.keyLRU.MoveToFront(el)
+		entry := el.Value.(*keyLimiterEntry)
+		return entry.limiter, &entry.priority
+	}
+
+	entry := &keyLimiterEntry{key: key, limiter: c.NewKeyLimiter()}
+	el := c.keyLRU.PushFront(entry)
+	c.keyLimiters[key] = el
+
+	if c.MaxKeys > 0 && c.keyLRU.Len() > c.MaxKeys {
+		oldest := c.keyLRU.Back()
+		if oldest != nil {
+			c.keyLRU.Remove(oldest)
+			delete(c.keyLimiters, oldest.Value.(*keyLimiterEntry).key)
+		}
+	}
+
+	return entry.limiter, &entry.priority
 }
 
 // NewClient returns a Client that rate limits requests through the provided HTTPClient.
 func NewClient(ctx context.Context, client HttpClient, limit int, unit time.Duration) *Client {
+	c := NewClientWithLimiter(ctx, client, NewTokenBucketLimiter(limit, unit))
+	c.unit = unit
+	c.MaxInFlight = limit
+	return c
+}
+
+// NewClientWithLimiter returns a Client that rate limits requests using the
+// provided RateLimiter, which may be shared across multiple Clients (e.g. to
+// enforce a single quota across several consumers, or to back the limit with
+// something other than an in-process token bucket).
+func NewClientWithLimiter(ctx context.Context, client HttpClient, limiter RateLimiter) *Client {
 	return &Client{
 		client:      client,
-		limit:       limit,
-		unit:        unit,
 		ctx:         ctx,
 		Retries:     5,
-		rateLimiter: rate.NewLimiter(rate.Every(unit/time.Duration(limit)), 1),
-		rateChan:    make(chan struct{}, limit),
+		rateLimiter: limiter,
+		// unit seeds the default retry policy's exponential backoff (see
+		// fullJitterBackoff). NewClient overwrites it with the caller's own
+		// unit; callers that want a different base for backoff with a custom
+		// RateLimiter should set their own RetryPolicy instead.
+		unit: defaultRetryBaseUnit,
+	}
+}
+
+// SetRateLimiter replaces the RateLimiter used by c.
+func (c *Client) SetRateLimiter(limiter RateLimiter) {
+	c.rateLimiter = limiter
+}
+
+// inFlightChan lazily creates the in-flight semaphore channel sized to
+// MaxInFlight. It returns nil when MaxInFlight <= 0, meaning no cap applies.
+func (c *Client) inFlightChan() chan struct{} {
+	c.rateChanOnce.Do(func() {
+		if c.MaxInFlight > 0 {
+			c.rateChan = make(chan struct{}, c.MaxInFlight)
+		}
+	})
+	return c.rateChan
+}
+
+// backoffCap is the maximum delay the default retry policy will ever return
+// for the exponential backoff fallback, regardless of the attempt count.
+const backoffCap = 30 * time.Second
+
+// defaultRetryBaseUnit is the backoff base NewClientWithLimiter falls back
+// to, since it (unlike NewClient) has no caller-supplied unit to derive one
+// from.
+const defaultRetryBaseUnit = time.Second
+
+// defaultRetryPolicy retries 429 and 503 responses. It honors the Retry-After
+// header when the server sends one (either delta-seconds or HTTP-date form),
+// and otherwise falls back to exponential backoff with full jitter, i.e.
+// a random duration in [0, min(backoffCap, c.unit * 2^attempt)).
+func (c *Client) defaultRetryPolicy(attempt int, resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		return false, 0
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return false, 0
+	}
+	if d, ok := parseRetryAfter(resp); ok {
+		return true, d
+	}
+	return true, fullJitterBackoff(c.unit, attempt)
+}
+
+// fullJitterBackoff returns a random duration in [0, min(backoffCap, base*2^attempt)),
+// following the "full jitter" strategy described in the AWS architecture blog.
+func fullJitterBackoff(base time.Duration, attempt int) time.Duration {
+	exp := base << uint(attempt)
+	if exp <= 0 || exp > backoffCap { // overflow or over cap
+		exp = backoffCap
+	}
+	return time.Duration(rand.Float64() * float64(exp))
+}
+
+// parseRetryAfter extracts the Retry-After header from resp, supporting both
+// the delta-seconds and HTTP-date forms defined in RFC 7231 section 7.1.3.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// RateLimitInfo is the quota state reported by a server on a response, as
+// parsed by a RateLimitHeaderParser.
+type RateLimitInfo struct {
+	// Remaining is the number of requests the server says are left in the
+	// current window.
+	Remaining int
+	// Limit is the size of the window, or 0 if the server didn't report one.
+	Limit int
+	// Reset is when Remaining returns to Limit, or the zero Time if unknown.
+	Reset time.Time
+}
+
+// RateLimitHeaderParser extracts RateLimitInfo from response headers. It
+// returns ok=false when the response carries none of the headers it looks for.
+type RateLimitHeaderParser interface {
+	Parse(h http.Header) (info RateLimitInfo, ok bool)
+}
+
+// headerParserFunc adapts a plain function to a RateLimitHeaderParser.
+type headerParserFunc func(h http.Header) (RateLimitInfo, bool)
+
+func (f headerParserFunc) Parse(h http.Header) (RateLimitInfo, bool) { return f(h) }
+
+// GitHubRateLimitHeaderParser parses the X-RateLimit-Remaining,
+// X-RateLimit-Limit and X-RateLimit-Reset (Unix timestamp) headers used by
+// the GitHub API and many others modeled after it.
+var GitHubRateLimitHeaderParser RateLimitHeaderParser = headerParserFunc(func(h http.Header) (RateLimitInfo, bool) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return RateLimitInfo{}, false
+	}
+	info := RateLimitInfo{Remaining: remaining}
+	if limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil {
+		info.Limit = limit
+	}
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		info.Reset = time.Unix(reset, 0)
+	}
+	return info, true
+})
+
+// RFCRateLimitHeaderParser parses the RateLimit-Remaining, RateLimit-Limit
+// and RateLimit-Reset (delta-seconds) headers from the IETF RateLimit Header
+// Fields for HTTP draft.
+var RFCRateLimitHeaderParser RateLimitHeaderParser = headerParserFunc(func(h http.Header) (RateLimitInfo, bool) {
+	remaining, err := strconv.Atoi(h.Get("RateLimit-Remaining"))
+	if err != nil {
+		return RateLimitInfo{}, false
+	}
+	info := RateLimitInfo{Remaining: remaining}
+	if limit, err := strconv.Atoi(h.Get("RateLimit-Limit")); err == nil {
+		info.Limit = limit
+	}
+	if secs, err := strconv.Atoi(h.Get("RateLimit-Reset")); err == nil {
+		info.Reset = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return info, true
+})
+
+// syncFromHeaders inspects resp using c.HeaderParser and, when the server
+// reports it has exhausted its quota, blocks subsequent Do calls until the
+// reported reset time. Otherwise, when the underlying limiter is a
+// token-bucket limiter, it reconciles that limiter's rate toward the pace the
+// server reports it will allow for the rest of the window — lowering it when
+// the server is stingier than expected, and raising it back (up to the
+// limiter's originally configured rate) once a fresh window allows more.
+func (c *Client) syncFromHeaders(resp *http.Response) {
+	if c.HeaderParser == nil || resp == nil {
+		return
+	}
+	info, ok := c.HeaderParser.Parse(resp.Header)
+	if !ok {
+		return
+	}
+
+	if info.Remaining == 0 && !info.Reset.IsZero() && info.Reset.After(time.Now()) {
+		c.setSyncBlockedUntil(info.Reset)
+		return
+	}
+
+	if tb, ok := c.rateLimiter.(*tokenBucketLimiter); ok && info.Limit > 0 && !info.Reset.IsZero() {
+		if window := time.Until(info.Reset); window > 0 {
+			actualRate := rate.Limit(float64(info.Remaining) / window.Seconds())
+			if actualRate > tb.configuredRate {
+				actualRate = tb.configuredRate
+			}
+			tb.limiter.SetLimit(actualRate)
+		}
+	}
+}
+
+func (c *Client) setSyncBlockedUntil(t time.Time) {
+	c.syncMu.Lock()
+	c.syncBlockedUntil = t
+	c.syncMu.Unlock()
+}
+
+// awaitHeaderSync blocks until any HeaderSync cooldown set by syncFromHeaders
+// has elapsed, or ctx is done. Callers can opt out per request with
+// WithSleepUntilReset(ctx, false).
+func (c *Client) awaitHeaderSync(ctx context.Context) error {
+	if sleep, ok := ctx.Value(sleepUntilResetContextKey{}).(bool); ok && !sleep {
+		return nil
 	}
+	c.syncMu.Lock()
+	until := c.syncBlockedUntil
+	c.syncMu.Unlock()
+	if d := time.Until(until); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
+// ErrCircuitOpen is returned by Do when the circuit breaker is open and is
+// short-circuiting requests instead of reaching the underlying HttpClient.
+var ErrCircuitOpen = errors.New("ratelimitclient: circuit breaker is open")
+
+// circuitBreakerState tracks failures in a rolling window and whether the
+// breaker is currently open (rejecting requests) or half-open (letting a
+// single probe through to decide whether to close again).
+type circuitBreakerState struct {
+	mu               sync.Mutex
+	failures         []time.Time
+	open             bool
+	openedAt         time.Time
+	halfOpenInFlight bool
+}
+
+// allow reports whether a request may proceed, opening a single half-open
+// probe through once cooldown has elapsed.
+func (s *circuitBreakerState) allow(cooldown time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open {
+		return nil
+	}
+	if time.Since(s.openedAt) < cooldown || s.halfOpenInFlight {
+		return ErrCircuitOpen
+	}
+	s.halfOpenInFlight = true
+	return nil
+}
+
+// recordResult folds the outcome of a request into the breaker's state,
+// opening it once failed requests within window reach threshold.
+func (s *circuitBreakerState) recordResult(threshold int, window time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.open {
+		s.halfOpenInFlight = false
+		s.open = failed // a failed probe reopens the circuit; openedAt restarts its cooldown
+		s.openedAt = time.Now()
+		s.failures = nil
+		return
+	}
+
+	now := time.Now()
+	if failed {
+		s.failures = append(s.failures, now)
+	}
+	cutoff := now.Add(-window)
+	kept := s.failures[:0]
+	for _, t := range s.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	s.failures = kept
+
+	if threshold > 0 && len(s.failures) >= threshold {
+		s.open = true
+		s.openedAt = now
+		s.failures = nil
+	}
+}
+
+// isCircuitFailure reports whether resp/err should count against the circuit
+// breaker's failure window: network errors always count, plus any status
+// code listed in CircuitBreakerStatusCodes.
+func (c *Client) isCircuitFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, code := range c.CircuitBreakerStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+type hedgeContextKey struct{}
+
+// WithHedging overrides, for req's context, whether Do may fire a hedged
+// second attempt when Client.HedgeAfter elapses. Without it, Do hedges GET
+// and HEAD requests, and PUT and DELETE requests whose body is empty or can be
+// re-created via req.GetBody, since firing two requests in parallel against a
+// single req.Body would race both attempts reading it; a PUT or DELETE whose
+// body can't be re-created can still be hedged by opting in explicitly
+// (ensure req.Body is safe for concurrent re-reading).
+func WithHedging(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, hedgeContextKey{}, enabled)
+}
+
+// hedgingEnabled reports whether req may be hedged, per WithHedging or,
+// absent an override, whether its method is idempotent and its body, if any,
+// can be re-created for the second attempt.
+func hedgingEnabled(req *http.Request) bool {
+	if v, ok := req.Context().Value(hedgeContextKey{}).(bool); ok {
+		return v
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return false
+	}
+}
+
+// hedgedDo sends req and, if no response has come back within c.HedgeAfter,
+// fires a second, identical request in parallel. It returns whichever
+// response comes back first, cancels the other in-flight attempt, and
+// closes the loser's response body once it arrives so a clean-but-late
+// loser doesn't leak its connection back to the pool.
+func (c *Client) hedgedDo(req *http.Request) (*http.Response, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+
+	primaryCtx, cancelPrimary := context.WithCancel(req.Context())
+	defer cancelPrimary()
+
+	results := make(chan result, 2)
+	go func() {
+		resp, err := c.client.Do(req.WithContext(primaryCtx))
+		results <- result{resp, err}
+	}()
+
+	timer := time.NewTimer(c.HedgeAfter)
+	defer timer.Stop()
+
+	select {
+	case r := <-results:
+		return r.resp, r.err
+	case <-timer.C:
+	}
+
+	hedgeCtx, cancelHedge := context.WithCancel(req.Context())
+	defer cancelHedge()
+	hedgeReq := req.WithContext(hedgeCtx)
+	if req.Body != nil && req.GetBody != nil {
+		// Give the hedge attempt its own body reader so it doesn't race the
+		// primary attempt over req.Body.
+		if body, err := req.GetBody(); err == nil {
+			hedgeReq.Body = body
+		}
+	}
+	go func() {
+		resp, err := c.client.Do(hedgeReq)
+		results <- result{resp, err}
+	}()
+
+	r := <-results
+	// The loser's send to results never blocks (it's buffered for exactly
+	// this), but nobody else will read it. Drain it in the background and
+	// close its body if it arrives cleanly, instead of leaking the
+	// connection it holds.
+	go func() {
+		if loser := <-results; loser.resp != nil {
+			loser.resp.Body.Close()
+		}
+	}()
+	return r.resp, r.err
+}
+
+// The following context keys let callers override a Client's behavior for a
+// single request, following the pattern used by google/go-github's
+// requestContext. Each has its own unexported key type so values set by one
+// helper can never collide with another package's context values.
+
+type retriesContextKey struct{}
+type bypassRateLimitContextKey struct{}
+type priorityContextKey struct{}
+type sleepUntilResetContextKey struct{}
+
+// WithRetries overrides, for req's context, how many times Do retries before
+// giving up, in place of Client.Retries.
+func WithRetries(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, retriesContextKey{}, n)
+}
+
+// WithBypassRateLimit makes Do skip both the rate limiter and the in-flight
+// cap for req. A HeaderSync cooldown (see WithSleepUntilReset) and the
+// circuit breaker still apply to it.
+func WithBypassRateLimit(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassRateLimitContextKey{}, true)
+}
+
+// WithPriority marks req as high priority. When multiple requests are
+// waiting to enter the rate limiter, high-priority ones are admitted first.
+func WithPriority(ctx context.Context, high bool) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, high)
+}
+
+// WithSleepUntilReset overrides, for req's context, whether Do blocks until a
+// HeaderSync-reported reset time (see Client.HeaderParser) before sending.
+func WithSleepUntilReset(ctx context.Context, sleep bool) context.Context {
+	return context.WithValue(ctx, sleepUntilResetContextKey{}, sleep)
+}
+
+func retriesFromContext(ctx context.Context, def int) int {
+	if n, ok := ctx.Value(retriesContextKey{}).(int); ok {
+		return n
+	}
+	return def
+}
+
+func bypassRateLimit(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassRateLimitContextKey{}).(bool)
+	return bypass
+}
+
+func highPriority(ctx context.Context) bool {
+	high, _ := ctx.Value(priorityContextKey{}).(bool)
+	return high
+}
+
+// priorityGate is a mutex that admits high-priority waiters (see
+// WithPriority) before low-priority ones whenever both are queued for it.
+type priorityGate struct {
+	mu   sync.Mutex
+	busy bool
+	high []chan struct{}
+	low  []chan struct{}
+}
+
+func (g *priorityGate) acquire(ctx context.Context, high bool) error {
+	g.mu.Lock()
+	if !g.busy {
+		g.busy = true
+		g.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	if high {
+		g.high = append(g.high, done)
+	} else {
+		g.low = append(g.low, done)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		removed := g.remove(done, high)
+		g.mu.Unlock()
+		if !removed {
+			// Lost the wakeup race: release() already dequeued us and handed
+			// us the gate before ctx.Done() was observed, so done is closed
+			// but g.remove found nothing to do. We're not going to use the
+			// gate, so pass it on ourselves instead of leaving it stuck busy.
+			g.release()
+		}
+		return ctx.Err()
+	}
+}
+
+// release hands the gate directly to the next queued waiter (high priority
+// first), or marks it free if nobody is waiting.
+func (g *priorityGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	q := &g.high
+	if len(*q) == 0 {
+		q = &g.low
+	}
+	if len(*q) == 0 {
+		g.busy = false
+		return
+	}
+	done := (*q)[0]
+	*q = (*q)[1:]
+	close(done)
+}
+
+// remove deletes done from its priority queue and reports whether it was
+// still there. It returns false when release() already dequeued done (and
+// thus handed the gate to it) before the caller could act on that.
+func (g *priorityGate) remove(done chan struct{}, high bool) bool {
+	q := &g.low
+	if high {
+		q = &g.high
+	}
+	for i, c := range *q {
+		if c == done {
+			*q = append((*q)[:i], (*q)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// mergeContexts returns a context that is done when either a or b is done,
+// carrying a's values and deadline/cancellation.
+func mergeContexts(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	go func() {
+		select {
+		case <-b.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// RateLimitError is returned by Do when the upstream server keeps responding
+// 429 Too Many Requests until retries are exhausted. It wraps ErrRateLimited
+// so errors.Is(err, ErrRateLimited) succeeds, and carries the final response
+// so callers can inspect headers such as Retry-After themselves.
+type RateLimitError struct {
+	// Response is the final 429 response received.
+	Response *http.Response
+	// RetryAfter is the server's Retry-After header on Response, parsed to a
+	// duration, or 0 if the header was absent or unparseable.
+	RetryAfter time.Duration
+	// Attempts is the number of requests made, including the first.
+	Attempts int
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("ratelimitclient: rate limited by upstream after %d attempt(s)", e.Attempts)
+}
+
+func (e *RateLimitError) Unwrap() error { return ErrRateLimited }
+
 // Do sends an HTTP request and returns an HTTP response using the underlying Client implementation
 // and makes sure requests are performed within its specified rate limit.
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	c.rateChan <- struct{}{}
+	ctx, cancel := mergeContexts(req.Context(), c.ctx)
+	defer cancel()
+
+	bypass := bypassRateLimit(ctx)
+
+	var rateChan chan struct{}
 	var noChanReceive bool
-	defer func() {
-		if !noChanReceive {
-			<-c.rateChan
+	if !bypass {
+		rateChan = c.inFlightChan()
+		if rateChan != nil {
+			rateChan <- struct{}{}
+			defer func() {
+				if !noChanReceive {
+					<-rateChan
+				}
+			}()
 		}
-	}()
-	if err := c.rateLimiter.Wait(c.ctx); err != nil {
+
+		limiter, gate := c.limiterForRequest(req)
+		high := highPriority(ctx)
+		if err := gate.acquire(ctx, high); err != nil {
+			return nil, err
+		}
+		err := limiter.Wait(ctx)
+		gate.release()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.awaitHeaderSync(ctx); err != nil {
 		return nil, err
 	}
+	retries := retriesFromContext(ctx, c.Retries)
 	for i := 0; true; i++ {
-		resp, err := c.client.Do(req)
-		if err != nil {
-			return resp, err
+		if c.CircuitBreakerThreshold > 0 {
+			if err := c.circuit.allow(c.CircuitBreakerCooldown); err != nil {
+				return nil, err
+			}
+		}
+
+		var resp *http.Response
+		var err error
+		if c.HedgeAfter > 0 && hedgingEnabled(req) {
+			resp, err = c.hedgedDo(req)
+		} else {
+			resp, err = c.client.Do(req)
 		}
 
-		if resp.StatusCode != 429 {
+		if c.CircuitBreakerThreshold > 0 {
+			c.circuit.recordResult(c.CircuitBreakerThreshold, c.CircuitBreakerWindow, c.isCircuitFailure(resp, err))
+		}
+		c.syncFromHeaders(resp)
+
+		var retry bool
+		var delay time.Duration
+		if c.RetryPolicy != nil {
+			retry, delay = c.RetryPolicy(resp, err)
+		} else {
+			retry, delay = c.defaultRetryPolicy(i, resp, err)
+		}
+		if !retry {
+			if err != nil {
+				return resp, err
+			}
 			noChanReceive = true
 			body := resp.Body
 			resp.Body = &readCloser{
 				r: body,
 				closeFn: func() error {
-					defer func() { <-c.rateChan }()
+					if rateChan != nil {
+						defer func() { <-rateChan }()
+					}
 					return body.Close()
 				},
 			}
 			return resp, err
 		}
 
-		if i >= c.Retries {
+		if i >= retries {
+			if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+				retryAfter, _ := parseRetryAfter(resp)
+				return resp, &RateLimitError{Response: resp, RetryAfter: retryAfter, Attempts: i + 1}
+			}
 			return resp, err
 		}
-		delay := time.Duration(rand.Float64() / 2 * float64(c.unit))
-		time.Sleep(c.unit + delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		}
 	}
-	panic("We should never get here")
+	return nil, nil
 }
 
 type readCloser struct {
@@ -2,12 +2,543 @@ package ratelimitclient
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// trackingBody is an io.ReadCloser that records whether it has been closed,
+// for tests that need to assert a response body was (or wasn't) returned to
+// the connection pool.
+type trackingBody struct {
+	io.Reader
+	closed int32
+}
+
+func (b *trackingBody) Close() error {
+	atomic.StoreInt32(&b.closed, 1)
+	return nil
+}
+
+func (b *trackingBody) Closed() bool { return atomic.LoadInt32(&b.closed) == 1 }
+
+// fakeLimiter is a RateLimiter whose behavior is fully controlled by the
+// test: Wait counts its calls and returns err, letting tests prove that a
+// Client actually calls through to whatever RateLimiter it's been given.
+type fakeLimiter struct {
+	waitCalls int32
+	err       error
+}
+
+func (f *fakeLimiter) Wait(ctx context.Context) error {
+	atomic.AddInt32(&f.waitCalls, 1)
+	return f.err
+}
+
+func (f *fakeLimiter) Allow() bool { return f.err == nil }
+
+func TestNewClientWithLimiter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	limiter := &fakeLimiter{}
+	client := NewClientWithLimiter(context.Background(), ts.Client(), limiter)
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("want status 200, got %d", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&limiter.waitCalls); got != 1 {
+		t.Fatalf("want 1 call to limiter.Wait, got %d", got)
+	}
+
+	// SetRateLimiter must replace the limiter Do consults, not just extend it.
+	limiter2 := &fakeLimiter{err: ErrRateLimited}
+	client.SetRateLimiter(limiter2)
+
+	req2, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req2); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("want ErrRateLimited after SetRateLimiter, got: %v", err)
+	}
+	if got := atomic.LoadInt32(&limiter.waitCalls); got != 1 {
+		t.Fatalf("want original limiter to stop being used after SetRateLimiter, waitCalls = %d", got)
+	}
+}
+
+// TestNewClientWithLimiterDefaultRetryBaseUnit guards against a zero-value
+// c.unit: fullJitterBackoff treats base <= 0 as overflow and always falls
+// back to a flat rand()*backoffCap delay, so NewClientWithLimiter's default
+// RetryPolicy would never actually exponentiate without a positive default.
+func TestNewClientWithLimiterDefaultRetryBaseUnit(t *testing.T) {
+	client := NewClientWithLimiter(context.Background(), http.DefaultClient, NewTokenBucketLimiter(100, time.Second))
+	if client.unit <= 0 {
+		t.Fatalf("want NewClientWithLimiter to default unit to a positive backoff base, got %v", client.unit)
+	}
+}
+
+func TestKeyFuncPerKeyLimiters(t *testing.T) {
+	client := NewClient(context.Background(), http.DefaultClient, 100, time.Second)
+	client.KeyFunc = func(req *http.Request) string { return req.Header.Get("X-Key") }
+	client.NewKeyLimiter = func() RateLimiter { return NewTokenBucketLimiter(100, time.Second) }
+
+	mkReq := func(key string) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Key", key)
+		return req
+	}
+
+	limA1, _ := client.limiterForRequest(mkReq("a"))
+	limA2, _ := client.limiterForRequest(mkReq("a"))
+	if limA1 != limA2 {
+		t.Error("want the same limiter instance returned for repeated requests with the same key")
+	}
+
+	limB, _ := client.limiterForRequest(mkReq("b"))
+	if limB == limA1 {
+		t.Error("want independent limiter instances for different keys")
+	}
+}
+
+func TestKeyFuncMaxKeysEviction(t *testing.T) {
+	client := NewClient(context.Background(), http.DefaultClient, 100, time.Second)
+	client.KeyFunc = func(req *http.Request) string { return req.Header.Get("X-Key") }
+	client.NewKeyLimiter = func() RateLimiter { return NewTokenBucketLimiter(100, time.Second) }
+	client.MaxKeys = 2
+
+	mkReq := func(key string) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Key", key)
+		return req
+	}
+
+	limA, _ := client.limiterForRequest(mkReq("a"))
+	client.limiterForRequest(mkReq("b"))
+	// "c" pushes the key count past MaxKeys, evicting "a" (the least recently used).
+	client.limiterForRequest(mkReq("c"))
+
+	limANew, _ := client.limiterForRequest(mkReq("a"))
+	if limANew == limA {
+		t.Error("want key \"a\" evicted once MaxKeys is exceeded, got the same limiter instance back")
+	}
+}
+
+func TestHeaderSyncBlocksUntilReset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	reset := time.Now().Add(1500 * time.Millisecond)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Limit", "100")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	client := NewClient(context.Background(), ts.Client(), 100, time.Second)
+	client.HeaderParser = GitHubRateLimitHeaderParser
+
+	req1, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req1); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	req2, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req2); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("want second Do to block until the header-reported reset time, only waited %v", elapsed)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	var fail int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	client := NewClient(context.Background(), ts.Client(), 100, time.Second)
+	client.Retries = 0
+	client.CircuitBreakerThreshold = 2
+	client.CircuitBreakerWindow = time.Minute
+	client.CircuitBreakerCooldown = 200 * time.Millisecond
+	client.CircuitBreakerStatusCodes = []int{500}
+
+	doReq := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client.Do(req)
+	}
+
+	// Two failures trip the breaker (CircuitBreakerThreshold = 2).
+	if _, err := doReq(); err != nil {
+		t.Fatalf("unexpected error on first failure: %v", err)
+	}
+	if _, err := doReq(); err != nil {
+		t.Fatalf("unexpected error on second failure: %v", err)
+	}
+
+	// The circuit is now open; further requests short-circuit with ErrCircuitOpen.
+	if _, err := doReq(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("want ErrCircuitOpen once the breaker trips, got: %v", err)
+	}
+
+	// After the cooldown, a half-open probe is let through. Make the server
+	// succeed so the breaker closes again.
+	time.Sleep(250 * time.Millisecond)
+	atomic.StoreInt32(&fail, 0)
+	resp, err := doReq()
+	if err != nil {
+		t.Fatalf("half-open probe failed: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("want 200 from the recovered server, got %d", resp.StatusCode)
+	}
+
+	resp, err = doReq()
+	if err != nil {
+		t.Fatalf("unexpected error after the breaker closed: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestHedgingFiresSecondAttempt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	var served int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&served, 1) == 1 {
+			time.Sleep(300 * time.Millisecond) // the primary attempt is slow
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	client := NewClient(context.Background(), ts.Client(), 100, time.Second)
+	client.HedgeAfter = 50 * time.Millisecond
+
+	start := time.Now()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("want the hedged attempt to win well before the slow primary's 300ms, took %v", elapsed)
+	}
+	if got := atomic.LoadInt32(&served); got < 2 {
+		t.Errorf("want at least 2 requests to reach the server (primary + hedge), got %d", got)
+	}
+}
+
+// fakeHedgeClient is an HttpClient whose first call (the primary attempt) is
+// slow, so the hedge attempt wins. It lets tests observe what happens to the
+// loser's response once it eventually arrives.
+type fakeHedgeClient struct {
+	calls       int32
+	primaryBody *trackingBody
+	hedgeBody   *trackingBody
+}
+
+func (c *fakeHedgeClient) Do(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		time.Sleep(200 * time.Millisecond)
+		return &http.Response{StatusCode: 200, Body: c.primaryBody}, nil
+	}
+	return &http.Response{StatusCode: 200, Body: c.hedgeBody}, nil
+}
+
+func TestHedgingClosesLosingResponseBody(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	primaryBody := &trackingBody{Reader: strings.NewReader("")}
+	hedgeBody := &trackingBody{Reader: strings.NewReader("")}
+	fc := &fakeHedgeClient{primaryBody: primaryBody, hedgeBody: hedgeBody}
+
+	client := NewClient(context.Background(), fc, 100, time.Second)
+	client.HedgeAfter = 20 * time.Millisecond
+
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The slow primary arrives ~200ms later, well after Do has already
+	// returned the hedge's response; its body must still get closed instead
+	// of leaking the connection it holds.
+	deadline := time.Now().Add(time.Second)
+	for !primaryBody.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("losing hedge attempt's response body was never closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithBypassRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	// A limiter that always fails, so only a bypass can let a request through.
+	limiter := &fakeLimiter{err: ErrRateLimited}
+	client := NewClientWithLimiter(context.Background(), ts.Client(), limiter)
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(WithBypassRateLimit(req.Context()))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("want WithBypassRateLimit to skip the failing limiter, got: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&limiter.waitCalls); got != 0 {
+		t.Errorf("want 0 calls to limiter.Wait under bypass, got %d", got)
+	}
+}
+
+func TestWithRetriesOverride(t *testing.T) {
+	var return429 int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&return429, -1) >= 0 {
+			w.WriteHeader(429)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	// Client.Retries would ride out the single 429, but WithRetries(0) should
+	// override that for this request and fail on the first try.
+	client := NewClient(context.Background(), ts.Client(), 100, time.Second)
+	client.Retries = 5
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(WithRetries(req.Context(), 0))
+
+	resp, err := client.Do(req)
+	var rlErr *RateLimitError
+	if !errors.As(err, &rlErr) {
+		t.Fatalf("want *RateLimitError with WithRetries(0), got: %v", err)
+	}
+	if resp.StatusCode != 429 {
+		t.Fatalf("want 429, got %d", resp.StatusCode)
+	}
+}
+
+// testNameKey tags a request's context with a name so recordingLimiter can
+// report the order requests were admitted in.
+type testNameKey struct{}
+
+// recordingLimiter blocks Wait until allow is closed, then records the
+// caller's name (from testNameKey) in admission order.
+type recordingLimiter struct {
+	mu    sync.Mutex
+	order []string
+	allow chan struct{}
+}
+
+func (l *recordingLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-l.allow:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if name, ok := ctx.Value(testNameKey{}).(string); ok {
+		l.mu.Lock()
+		l.order = append(l.order, name)
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+func (l *recordingLimiter) Allow() bool { return true }
+
+func TestWithPriority(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	limiter := &recordingLimiter{allow: make(chan struct{})}
+	client := NewClientWithLimiter(context.Background(), ts.Client(), limiter)
+
+	mkReq := func(name string, high bool) *http.Request {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithValue(req.Context(), testNameKey{}, name)
+		ctx = WithPriority(ctx, high)
+		return req.WithContext(ctx)
+	}
+
+	var wg sync.WaitGroup
+
+	// "holder" is admitted immediately (the gate starts free) and then blocks
+	// in limiter.Wait, holding the gate until we close limiter.allow below.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := client.Do(mkReq("holder", false)); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Both "low" and "high" now queue on the gate behind "holder".
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := client.Do(mkReq("low", false)); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := client.Do(mkReq("high", true)); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	close(limiter.allow)
+	wg.Wait()
+
+	limiter.mu.Lock()
+	order := append([]string(nil), limiter.order...)
+	limiter.mu.Unlock()
+
+	if len(order) != 3 || order[0] != "holder" || order[1] != "high" || order[2] != "low" {
+		t.Fatalf("want admission order [holder high low], got %v", order)
+	}
+}
+
+// TestPriorityGateCancelRace exercises ctx cancellation racing with a
+// concurrent release(): a queued waiter's context can be canceled in the
+// same instant release() hands it the gate, so the select in acquire may
+// observe ctx.Done() even though it already owns the gate. If acquire
+// doesn't detect and correct for that, the gate is left busy forever with
+// both queues empty.
+func TestPriorityGateCancelRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	for trial := 0; trial < 2000; trial++ {
+		var g priorityGate
+		if err := g.acquire(context.Background(), false); err != nil {
+			t.Fatalf("trial %d: initial acquire: %v", trial, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		raceDone := make(chan struct{})
+		go func() {
+			defer close(raceDone)
+			if err := g.acquire(ctx, false); err == nil {
+				// We won the race and own the gate; release it like any
+				// successful acquirer must.
+				g.release()
+			}
+		}()
+		time.Sleep(time.Millisecond)
+
+		// Race the waiter's cancellation against the handoff.
+		cancel()
+		g.release()
+		<-raceDone
+
+		// The gate must still be usable afterward, however the race above
+		// resolved.
+		acquired := make(chan error, 1)
+		go func() { acquired <- g.acquire(context.Background(), false) }()
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Fatalf("trial %d: gate unusable after race: %v", trial, err)
+			}
+			g.release()
+		case <-time.After(time.Second):
+			t.Fatalf("trial %d: gate deadlocked after cancellation raced with release", trial)
+		}
+	}
+}
+
 func TestRateLimitClientRetry(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping in short mode")
@@ -24,13 +555,20 @@ func TestRateLimitClientRetry(t *testing.T) {
 	}))
 	client := NewClient(context.Background(), ts.Client(), 100, time.Second)
 
-	assertResponse := func(testName string, wantStatusCode int) bool {
+	// wantRateLimitErr is true when retries are exhausted on a 429, in which
+	// case Do returns a *RateLimitError rather than a nil error.
+	assertResponse := func(testName string, wantStatusCode int, wantRateLimitErr bool) bool {
 		req, err := http.NewRequest("GET", ts.URL, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
 		resp, err := client.Do(req)
-		if err != nil {
+		if wantRateLimitErr {
+			var rlErr *RateLimitError
+			if !errors.As(err, &rlErr) {
+				t.Fatalf("Test '%s': want *RateLimitError, got: %v", testName, err)
+			}
+		} else if err != nil {
 			t.Fatalf("Test '%s': error: %v", testName, err)
 		}
 		if resp.StatusCode != wantStatusCode {
@@ -42,17 +580,17 @@ func TestRateLimitClientRetry(t *testing.T) {
 	// When client.Retries = 0, do not retry requests and return original response when server returns 429
 	client.Retries = 0
 	return429 = 1 // Return 429 one time
-	assertResponse("No retries", 429)
+	assertResponse("No retries", 429, true)
 
 	// When client.Retries > N (N > 0), retry N times
 	client.Retries = 2
 	return429 = client.Retries
-	assertResponse("Successful retries", 200)
+	assertResponse("Successful retries", 200, false)
 
 	// When client.Retries > N (N > 0), retry N times, then return original response when request N + 1 also returns 429
 	client.Retries = 2
 	return429 = client.Retries + 1
-	assertResponse("Unsuccessful retries", 429)
+	assertResponse("Unsuccessful retries", 429, true)
 }
 
 /*